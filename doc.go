@@ -34,5 +34,42 @@ When registering routes, user's can use either the RegisterResp method
 which accepts a static response code and body to be returned for a
 matching request, or the RegisterFunc method which takes a traditional
 handler function.
+
+Registered paths may contain :name segments that capture a single path
+segment, and may end with a *rest segment that captures the remainder of
+the path. Captured values are made available to a RegisterFunc handler via
+ParamsFromContext.
+
+		router.RegisterFunc("GET", "/widgets/:id", func(w http.ResponseWriter, r *http.Request) {
+			id := testmux.ParamsFromContext(r.Context())["id"]
+			fmt.Fprintln(w, "Widget "+id)
+		})
+
+Middleware can be applied around every request with Router.Use, or around a
+single route by calling Use on the value returned from RegisterFunc or
+RegisterResp. Router-wide middleware wraps route-specific middleware, which
+in turn wraps the route's handler.
+
+When method and path aren't enough to tell two requests apart, the fluent
+Register method returns a *Route that can be narrowed with WithHeader,
+WithQuery, and WithBodyJSON before a terminal call to HandlerFunc or
+RespondWith:
+
+		router.Register("POST", "/widgets").
+			WithHeader("X-Api-Key", "abc").
+			WithBodyJSON(Widget{Name: "sprocket"}).
+			RespondWith(202, "Accepted")
+
+A route registered with Times(n) is satisfied by n sequential requests
+before it is exhausted; Times(-1) allows it to match an unlimited number of
+requests. A Router is safe for concurrent use from multiple goroutines, and
+setting AllowUnordered disables the sequence check entirely, matching
+requests to any unvisited route regardless of registration order.
+
+Every dispatched request is captured and can be retrieved with the
+Recorded method, which returns the method, path, headers, and body of each
+request along with the route it matched. AssertRequestJSON and
+AssertRequestHeader build on Recorded to make claims about a specific
+request's payload without embedding those assertions inside a handler.
 */
 package testmux
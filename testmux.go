@@ -1,8 +1,15 @@
 package testmux // import "github.com/CenturyLinkLabs/testmux"
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
 )
 
@@ -10,59 +17,230 @@ import (
 // handler. It will track handled requests to ensure that they are received
 // in the same order in which they were originally registered.
 //
-// It implements the http.Hander interface.
+// It implements the http.Hander interface. A Router is safe for concurrent
+// use by multiple goroutines calling ServeHTTP.
 type Router struct {
-	routes []route
-	index  int
-	errors []string
+	// RawPath, when true, matches registered routes against
+	// req.URL.EscapedPath() instead of req.URL.Path, so that an escaped
+	// sequence such as %2F captured by a :name or *rest segment is not
+	// mistaken for a path separator.
+	RawPath bool
+
+	// AllowUnordered, when true, disables the sequence check: a request is
+	// matched against any unvisited route with a matching method, path, and
+	// matchers, regardless of the order in which routes were registered.
+	// Useful when the code under test issues requests from multiple
+	// goroutines.
+	AllowUnordered bool
+
+	mu          sync.Mutex
+	routes      []*Route
+	index       int
+	errors      []string
+	middlewares []func(http.Handler) http.Handler
+	recorded    []RecordedRequest
+}
+
+// RecordedRequest is a snapshot of a single request dispatched through the
+// Router, captured before its matched handler runs.
+type RecordedRequest struct {
+	Method string
+	Path   string
+	Header http.Header
+	Body   []byte
+
+	// RouteIndex is the index, in registration order, of the route this
+	// request matched, or -1 if the request was unmatched.
+	RouteIndex int
+
+	// Ordered reports whether the request was received in the correct
+	// sequence. Always false for an unmatched request.
+	Ordered bool
 }
 
-type route struct {
-	method  string
-	path    string
-	handler func(http.ResponseWriter, *http.Request)
-	visited bool
+// Route describes a registered method, path, and any additional matchers
+// that an incoming request must satisfy, along with the handler to invoke
+// when it does. Routes are created via RegisterFunc, RegisterResp, or the
+// fluent Register.
+type Route struct {
+	method      string
+	path        string
+	handler     func(http.ResponseWriter, *http.Request)
+	remaining   int
+	hits        int
+	middlewares []func(http.Handler) http.Handler
+	matchers    []matcher
 }
 
-// RegisterFunc registers a handler function for the given request method and
-// path.
-func (r *Router) RegisterFunc(method, path string, handler func(http.ResponseWriter, *http.Request)) {
-	rte := route{method: method, path: path, handler: handler}
+// Params holds the named path parameters captured while matching a request
+// path against a route registered with :name segments, along with any value
+// captured by a trailing *rest segment.
+type Params map[string]string
+
+type paramsKey struct{}
+
+// ParamsFromContext returns the Params captured for the current request, or
+// nil if the matched route had no :name or *rest segments. It is intended
+// to be called from within a handler passed to RegisterFunc.
+func ParamsFromContext(ctx context.Context) Params {
+	p, _ := ctx.Value(paramsKey{}).(Params)
+	return p
+}
+
+// Register begins a fluent route registration for the given request method
+// and path, as described in RegisterFunc. Matchers such as WithHeader,
+// WithQuery, and WithBodyJSON can be layered on before a terminal call to
+// HandlerFunc or RespondWith.
+func (r *Router) Register(method, path string) *Route {
+	rte := &Route{method: method, path: path, remaining: 1}
+
+	r.mu.Lock()
 	r.routes = append(r.routes, rte)
+	r.mu.Unlock()
+
+	return rte
+}
+
+// RegisterFunc registers a handler function for the given request method and
+// path. The path may contain :name segments, which match a single path
+// segment and are captured into the request's Params, and may end with a
+// *rest segment, which matches the remainder of the path.
+//
+// The returned Route can be used to attach route-specific middleware via
+// Use.
+func (r *Router) RegisterFunc(method, path string, handler func(http.ResponseWriter, *http.Request)) *Route {
+	return r.Register(method, path).HandlerFunc(handler)
 }
 
 // RegisterResp registers a static status code and body string to be returned
-// for the given request method and path.
-func (r *Router) RegisterResp(method, path string, status int, body string) {
-	rte := route{
-		method: method,
-		path:   path,
-		handler: func(w http.ResponseWriter, r *http.Request) {
-			w.WriteHeader(status)
-			fmt.Fprintln(w, body)
-		},
+// for the given request method and path. The path may contain :name and
+// *rest segments as described in RegisterFunc.
+//
+// The returned Route can be used to attach route-specific middleware via
+// Use.
+func (r *Router) RegisterResp(method, path string, status int, body string) *Route {
+	return r.Register(method, path).RespondWith(status, body)
+}
+
+// HandlerFunc sets the handler to be invoked for a request matching this
+// route and returns the route, for use as the terminal call of a fluent
+// Register chain.
+func (rte *Route) HandlerFunc(handler func(http.ResponseWriter, *http.Request)) *Route {
+	rte.handler = handler
+	return rte
+}
+
+// RespondWith sets a static status code and body string to be returned for
+// a request matching this route, for use as the terminal call of a fluent
+// Register chain.
+func (rte *Route) RespondWith(status int, body string) *Route {
+	rte.handler = func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		fmt.Fprintln(w, body)
 	}
+	return rte
+}
 
-	r.routes = append(r.routes, rte)
+// WithHeader requires a matching request to carry the given header value, in
+// addition to this route's method and path.
+func (rte *Route) WithHeader(key, value string) *Route {
+	rte.matchers = append(rte.matchers, headerMatcher{key: key, value: value})
+	return rte
+}
+
+// WithQuery requires a matching request's URL query string to carry the
+// given value, in addition to this route's method and path.
+func (rte *Route) WithQuery(key, value string) *Route {
+	rte.matchers = append(rte.matchers, queryMatcher{key: key, value: value})
+	return rte
+}
+
+// WithBodyJSON requires a matching request's body to be JSON that is
+// equivalent to the JSON encoding of v, in addition to this route's method
+// and path. The request body is read and re-buffered so that the handler
+// can still read it.
+func (rte *Route) WithBodyJSON(v interface{}) *Route {
+	rte.matchers = append(rte.matchers, bodyJSONMatcher{want: v})
+	return rte
+}
+
+// Times sets the number of sequential requests this route will satisfy
+// before it is exhausted and no longer matched. A route satisfies one
+// request by default. Times(-1) allows the route to match an unlimited
+// number of requests. It returns the route to allow chained calls.
+func (rte *Route) Times(n int) *Route {
+	rte.remaining = n
+	return rte
+}
+
+// Use appends middleware to be applied, outer-first, to every request
+// dispatched by the Router, wrapping any route-specific middleware
+// registered via the route's own Use method.
+func (r *Router) Use(mw ...func(http.Handler) http.Handler) {
+	r.mu.Lock()
+	r.middlewares = append(r.middlewares, mw...)
+	r.mu.Unlock()
+}
+
+// Use appends middleware to be applied, outer-first, around this route's
+// handler only, inside any Router-wide middleware. It returns the route to
+// allow chained calls.
+func (rte *Route) Use(mw ...func(http.Handler) http.Handler) *Route {
+	rte.middlewares = append(rte.middlewares, mw...)
+	return rte
 }
 
 // ServeHTTP dispatches the handler registered in the matched route and tracks
 // whether the route was requested in the correct order.
 func (r *Router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	rte, ordered := r.match(req.Method, req.URL.Path)
+	path := req.URL.Path
+	if r.RawPath {
+		path = req.URL.EscapedPath()
+	}
 
-	if rte != nil {
-		rte.execute(w, req)
+	var body []byte
+	if req.Body != nil {
+		body, _ = io.ReadAll(req.Body)
+		req.Body.Close()
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	r.mu.Lock()
+	rte, params, ordered, failReason, idx := r.match(req.Method, path, req, body)
+	mw := append([]func(http.Handler) http.Handler{}, r.middlewares...)
 
-		if !ordered {
-			r.addErrorf("Request out of order: %s %s", req.Method, req.URL.Path)
+	r.recorded = append(r.recorded, RecordedRequest{
+		Method:     req.Method,
+		Path:       path,
+		Header:     req.Header.Clone(),
+		Body:       append([]byte{}, body...),
+		RouteIndex: idx,
+		Ordered:    rte != nil && ordered,
+	})
+
+	switch {
+	case rte != nil && !ordered:
+		r.addErrorf("Request out of order: %s %s", req.Method, path)
+	case rte == nil:
+		msg := fmt.Sprintf("Unexpected request: %s %s", req.Method, path)
+		if failReason != "" {
+			msg += " (" + failReason + ")"
 		}
-	} else {
+		r.addErrorf("%s", msg)
+	}
+
+	r.mu.Unlock()
+
+	if rte == nil {
 		http.NotFound(w, req)
-		r.addErrorf("Unexpected request: %s %s", req.Method, req.URL.Path)
+		return
+	}
+
+	if params != nil {
+		req = req.WithContext(context.WithValue(req.Context(), paramsKey{}, params))
 	}
 
-	r.index++
+	rte.invoke(w, req, mw)
 }
 
 // AssertVisited asserts that all of the registered routes were visited in the
@@ -72,17 +250,83 @@ func (r *Router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 //
 // Returns whether the assertion was successful (true) or not (false).
 func (r *Router) AssertVisited(t *testing.T) bool {
+	r.mu.Lock()
 	for _, rte := range r.routes {
-		if !rte.visited {
+		if rte.remaining > 0 || (rte.remaining < 0 && rte.hits == 0) {
 			r.addErrorf("Unvisited route: %s %s", rte.method, rte.path)
 		}
 	}
+	errs := append([]string{}, r.errors...)
+	r.mu.Unlock()
 
-	for _, err := range r.errors {
+	for _, err := range errs {
 		t.Error(err)
 	}
 
-	return len(r.errors) == 0
+	return len(errs) == 0
+}
+
+// Recorded returns a snapshot of every request dispatched through the
+// Router so far, in the order they were received.
+func (r *Router) Recorded() []RecordedRequest {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]RecordedRequest{}, r.recorded...)
+}
+
+// AssertRequestJSON asserts that the body of the i'th recorded request is
+// JSON equivalent to the JSON encoding of v.
+//
+// Returns whether the assertion was successful (true) or not (false).
+func (r *Router) AssertRequestJSON(t *testing.T, i int, v interface{}) bool {
+	recorded := r.Recorded()
+	if i < 0 || i >= len(recorded) {
+		t.Errorf("AssertRequestJSON: no recorded request at index %d", i)
+		return false
+	}
+
+	wantJSON, err := json.Marshal(v)
+	if err != nil {
+		t.Errorf("AssertRequestJSON: invalid expected value: %s", err)
+		return false
+	}
+
+	var want, got interface{}
+	if err := json.Unmarshal(wantJSON, &want); err != nil {
+		t.Errorf("AssertRequestJSON: invalid expected value: %s", err)
+		return false
+	}
+	if err := json.Unmarshal(recorded[i].Body, &got); err != nil {
+		t.Errorf("AssertRequestJSON: request %d body is not valid JSON: %s", i, err)
+		return false
+	}
+
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("AssertRequestJSON: request %d body: want JSON %s, got %s", i, wantJSON, recorded[i].Body)
+		return false
+	}
+
+	return true
+}
+
+// AssertRequestHeader asserts that the i'th recorded request carried the
+// given header value.
+//
+// Returns whether the assertion was successful (true) or not (false).
+func (r *Router) AssertRequestHeader(t *testing.T, i int, key, want string) bool {
+	recorded := r.Recorded()
+	if i < 0 || i >= len(recorded) {
+		t.Errorf("AssertRequestHeader: no recorded request at index %d", i)
+		return false
+	}
+
+	if got := recorded[i].Header.Get(key); got != want {
+		t.Errorf("AssertRequestHeader: request %d header %s: want %q, got %q", i, key, want, got)
+		return false
+	}
+
+	return true
 }
 
 // Adds an error string to the internal collection.
@@ -90,22 +334,181 @@ func (r *Router) addErrorf(format string, a ...interface{}) {
 	r.errors = append(r.errors, fmt.Sprintf(format, a...))
 }
 
-// Given an HTTP method and request path, looks for a matching handler which
-// has not already been visited. Returns the handler along with a flag
-// indicating whether or not the handler is being invoked in the correct
-// order.
-func (r *Router) match(method, path string) (*route, bool) {
+// Given an HTTP method, request path, and the request itself (with its body
+// already buffered into body), looks for a matching route that has not
+// exhausted its remaining Times count. On a match, the route's remaining
+// count is consumed, and r.index (the registration index a route must
+// occupy to be considered in-order) only advances once that consumption
+// exhausts the route, so a Times(n) route stays the expected match across
+// all n of the requests it satisfies. Returns the route along with any
+// captured path Params, a flag indicating whether or not the route is being
+// matched in the correct order (always true when the Router's
+// AllowUnordered is set), and the route's registration index (-1 if no
+// route matched). If no route matches, the returned reason describes which
+// matcher failed on the closest candidate, to aid debugging. Callers must
+// hold r.mu.
+func (r *Router) match(method, path string, req *http.Request, body []byte) (*Route, Params, bool, string, int) {
+	var failReason string
+
 	for i, rte := range r.routes {
-		if !rte.visited && rte.method == method && rte.path == path {
-			return &r.routes[i], (i == r.index)
+		if rte.remaining == 0 || rte.method != method {
+			continue
+		}
+
+		params, ok := matchPath(rte.path, path)
+		if !ok {
+			continue
+		}
+
+		if ok, reason := rte.matches(req, body); !ok {
+			if failReason == "" {
+				failReason = reason
+			}
+			continue
+		}
+
+		ordered := r.AllowUnordered || i == r.index
+		if rte.remaining > 0 {
+			rte.remaining--
+		}
+		rte.hits++
+
+		if rte.remaining == 0 {
+			r.index++
+		}
+
+		return rte, params, ordered, "", i
+	}
+
+	return nil, nil, false, failReason, -1
+}
+
+// invoke runs the handler associated with the route, wrapped by the
+// Router's middleware and then the route's own middleware.
+func (rte *Route) invoke(w http.ResponseWriter, req *http.Request, routerMW []func(http.Handler) http.Handler) {
+	var h http.Handler = http.HandlerFunc(rte.handler)
+
+	chain := append(append([]func(http.Handler) http.Handler{}, routerMW...), rte.middlewares...)
+	for i := len(chain) - 1; i >= 0; i-- {
+		h = chain[i](h)
+	}
+
+	h.ServeHTTP(w, req)
+}
+
+// matches reports whether every matcher registered on the route is
+// satisfied by the given request, returning a description of the first
+// matcher to fail, if any.
+func (rte *Route) matches(req *http.Request, body []byte) (bool, string) {
+	for _, m := range rte.matchers {
+		if ok, reason := m.match(req, body); !ok {
+			return false, reason
+		}
+	}
+
+	return true, ""
+}
+
+// matcher is an additional condition, beyond method and path, that an
+// incoming request must satisfy to be matched against a Route.
+type matcher interface {
+	match(req *http.Request, body []byte) (ok bool, reason string)
+}
+
+type headerMatcher struct {
+	key, value string
+}
+
+func (m headerMatcher) match(req *http.Request, _ []byte) (bool, string) {
+	if got := req.Header.Get(m.key); got != m.value {
+		return false, fmt.Sprintf("header %s: want %q, got %q", m.key, m.value, got)
+	}
+
+	return true, ""
+}
+
+type queryMatcher struct {
+	key, value string
+}
+
+func (m queryMatcher) match(req *http.Request, _ []byte) (bool, string) {
+	if got := req.URL.Query().Get(m.key); got != m.value {
+		return false, fmt.Sprintf("query %s: want %q, got %q", m.key, m.value, got)
+	}
+
+	return true, ""
+}
+
+type bodyJSONMatcher struct {
+	want interface{}
+}
+
+func (m bodyJSONMatcher) match(_ *http.Request, body []byte) (bool, string) {
+	wantJSON, err := json.Marshal(m.want)
+	if err != nil {
+		return false, fmt.Sprintf("body: invalid expected value: %s", err)
+	}
+
+	var want, got interface{}
+	if err := json.Unmarshal(wantJSON, &want); err != nil {
+		return false, fmt.Sprintf("body: invalid expected value: %s", err)
+	}
+	if err := json.Unmarshal(body, &got); err != nil {
+		return false, fmt.Sprintf("body: invalid request JSON: %s", err)
+	}
+
+	if !reflect.DeepEqual(want, got) {
+		return false, fmt.Sprintf("body: want JSON %s, got %s", wantJSON, body)
+	}
+
+	return true, ""
+}
+
+// matchPath compares a registered route pattern against an incoming request
+// path segment-by-segment. A pattern segment prefixed with ":" captures the
+// corresponding path segment by name. A pattern segment prefixed with "*"
+// captures the remainder of the path, including any subsequent slashes, and
+// must be the final segment of the pattern. Any other segment must match the
+// path exactly. It returns the captured Params (nil if the pattern contains
+// no :name or *rest segments) and whether the path matched the pattern.
+func matchPath(pattern, path string) (Params, bool) {
+	pSegs := splitPath(pattern)
+	rSegs := splitPath(path)
+
+	var params Params
+
+	for i, seg := range pSegs {
+		switch {
+		case strings.HasPrefix(seg, "*"):
+			if params == nil {
+				params = Params{}
+			}
+			params[seg[1:]] = strings.Join(rSegs[i:], "/")
+			return params, true
+		case strings.HasPrefix(seg, ":"):
+			if i >= len(rSegs) {
+				return nil, false
+			}
+			if params == nil {
+				params = Params{}
+			}
+			params[seg[1:]] = rSegs[i]
+		default:
+			if i >= len(rSegs) || rSegs[i] != seg {
+				return nil, false
+			}
 		}
 	}
 
-	return nil, false
+	if len(rSegs) != len(pSegs) {
+		return nil, false
+	}
+
+	return params, true
 }
 
-// Execute the handler associated with the route and mark it as visited.
-func (rte *route) execute(w http.ResponseWriter, req *http.Request) {
-	rte.handler(w, req)
-	rte.visited = true
+// splitPath splits a "/"-delimited path into its segments, ignoring any
+// leading or trailing slash.
+func splitPath(path string) []string {
+	return strings.Split(strings.Trim(path, "/"), "/")
 }
@@ -1,8 +1,12 @@
 package testmux
 
 import (
+	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -133,6 +137,352 @@ func TestAssertVisited_Success(t *testing.T) {
 	assert.False(t, tt.Failed())
 }
 
+func TestServeHTTP_PathParams(t *testing.T) {
+	var params Params
+
+	router := Router{}
+	router.RegisterFunc("GET", "/widgets/:id", func(w http.ResponseWriter, r *http.Request) {
+		params = ParamsFromContext(r.Context())
+	})
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/widgets/42", nil)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, Params{"id": "42"}, params)
+	assert.Empty(t, router.errors)
+}
+
+func TestServeHTTP_WildcardParam(t *testing.T) {
+	var params Params
+
+	router := Router{}
+	router.RegisterFunc("GET", "/files/*path", func(w http.ResponseWriter, r *http.Request) {
+		params = ParamsFromContext(r.Context())
+	})
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/files/a/b/c.txt", nil)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, Params{"path": "a/b/c.txt"}, params)
+	assert.Empty(t, router.errors)
+}
+
+func TestServeHTTP_RawPath(t *testing.T) {
+	router := Router{RawPath: true}
+	router.RegisterFunc("GET", "/files/*path", func(w http.ResponseWriter, r *http.Request) {
+		params := ParamsFromContext(r.Context())
+		fmt.Fprint(w, params["path"])
+	})
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/files/a%2Fb", nil)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, "a%2Fb", w.Body.String())
+	assert.Empty(t, router.errors)
+}
+
+func TestServeHTTP_MiddlewareOrdering(t *testing.T) {
+	var order []string
+	mark := func(name string) func(http.Handler) http.Handler {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				order = append(order, name)
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+
+	router := Router{}
+	router.Use(mark("outer"), mark("inner"))
+	router.RegisterResp("GET", "/foo", 200, "")
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/foo", nil)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, []string{"outer", "inner"}, order)
+	assert.Empty(t, router.errors)
+}
+
+func TestServeHTTP_PerRouteMiddleware(t *testing.T) {
+	var order []string
+	mark := func(name string) func(http.Handler) http.Handler {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				order = append(order, name)
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+
+	router := Router{}
+	router.Use(mark("router"))
+	router.RegisterResp("GET", "/foo", 200, "").Use(mark("route"))
+	router.RegisterResp("GET", "/bar", 200, "")
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/foo", nil)
+	router.ServeHTTP(w, req)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/bar", nil)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, []string{"router", "route", "router"}, order)
+	assert.Empty(t, router.errors)
+}
+
+func TestServeHTTP_MiddlewareSkippedOnUnmatchedRequest(t *testing.T) {
+	var called bool
+	router := Router{}
+	router.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			called = true
+			next.ServeHTTP(w, r)
+		})
+	})
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/missing", nil)
+	router.ServeHTTP(w, req)
+
+	assert.False(t, called)
+	assert.Equal(t, 404, w.Code)
+}
+
+func TestServeHTTP_MiddlewareRunsOutOfOrder(t *testing.T) {
+	var called bool
+	router := Router{}
+	router.RegisterResp("GET", "/foo", 200, "")
+	router.RegisterResp("GET", "/bar", 200, "").Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			called = true
+			next.ServeHTTP(w, r)
+		})
+	})
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/bar", nil)
+	router.ServeHTTP(w, req)
+
+	assert.True(t, called)
+	assert.Contains(t, router.errors, "Request out of order: GET /bar")
+
+	tt := &testing.T{}
+	router.AssertVisited(tt)
+	assert.True(t, tt.Failed())
+}
+
+func TestServeHTTP_WithHeader(t *testing.T) {
+	router := Router{}
+	router.Register("POST", "/foo").WithHeader("X-Api-Key", "abc").RespondWith(202, "")
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/foo", nil)
+	req.Header.Set("X-Api-Key", "abc")
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 202, w.Code)
+	assert.Empty(t, router.errors)
+}
+
+func TestServeHTTP_WithQuery(t *testing.T) {
+	router := Router{}
+	router.Register("GET", "/foo").WithQuery("v", "2").RespondWith(202, "")
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/foo?v=2", nil)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 202, w.Code)
+	assert.Empty(t, router.errors)
+}
+
+func TestServeHTTP_WithBodyJSON(t *testing.T) {
+	var gotBody string
+
+	router := Router{}
+	router.Register("POST", "/foo").
+		WithBodyJSON(map[string]string{"name": "sprocket"}).
+		HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			b, _ := io.ReadAll(r.Body)
+			gotBody = string(b)
+			w.WriteHeader(202)
+		})
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/foo", strings.NewReader(`{"name":"sprocket"}`))
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 202, w.Code)
+	assert.Equal(t, `{"name":"sprocket"}`, gotBody)
+	assert.Empty(t, router.errors)
+}
+
+func TestServeHTTP_UnmatchedMatcherReportsReason(t *testing.T) {
+	router := Router{}
+	router.Register("POST", "/foo").WithHeader("X-Api-Key", "abc").RespondWith(202, "")
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/foo", nil)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 404, w.Code)
+	assert.Len(t, router.errors, 1)
+	assert.Contains(t, router.errors[0], "Unexpected request: POST /foo")
+	assert.Contains(t, router.errors[0], `header X-Api-Key: want "abc", got ""`)
+}
+
+func TestServeHTTP_Times(t *testing.T) {
+	router := Router{}
+	router.RegisterResp("GET", "/foo", 200, "").Times(3)
+
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/foo", nil)
+		router.ServeHTTP(w, req)
+		assert.Equal(t, 200, w.Code)
+	}
+
+	tt := &testing.T{}
+	router.AssertVisited(tt)
+	assert.False(t, tt.Failed())
+}
+
+func TestServeHTTP_TimesNotSatisfied(t *testing.T) {
+	router := Router{}
+	router.RegisterResp("GET", "/foo", 200, "").Times(3)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/foo", nil)
+	router.ServeHTTP(w, req)
+
+	tt := &testing.T{}
+	router.AssertVisited(tt)
+	assert.True(t, tt.Failed())
+	assert.Contains(t, router.errors, "Unvisited route: GET /foo")
+}
+
+func TestServeHTTP_TimesUnlimited(t *testing.T) {
+	router := Router{}
+	router.RegisterResp("GET", "/foo", 200, "").Times(-1)
+
+	for i := 0; i < 5; i++ {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/foo", nil)
+		router.ServeHTTP(w, req)
+		assert.Equal(t, 200, w.Code)
+	}
+
+	tt := &testing.T{}
+	router.AssertVisited(tt)
+	assert.False(t, tt.Failed())
+}
+
+func TestServeHTTP_AllowUnordered(t *testing.T) {
+	router := Router{AllowUnordered: true}
+	router.RegisterResp("GET", "/foo", 200, "")
+	router.RegisterResp("GET", "/bar", 201, "")
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/bar", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 201, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/foo", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	assert.Empty(t, router.errors)
+
+	tt := &testing.T{}
+	router.AssertVisited(tt)
+	assert.False(t, tt.Failed())
+}
+
+func TestServeHTTP_ConcurrentDispatch(t *testing.T) {
+	router := Router{AllowUnordered: true}
+	router.RegisterResp("GET", "/foo", 200, "").Times(50)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/foo", nil)
+			router.ServeHTTP(w, req)
+		}()
+	}
+	wg.Wait()
+
+	tt := &testing.T{}
+	router.AssertVisited(tt)
+	assert.False(t, tt.Failed())
+}
+
+func TestServeHTTP_Recorded(t *testing.T) {
+	router := Router{}
+	router.RegisterResp("POST", "/foo", 202, "")
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/foo", strings.NewReader(`{"name":"sprocket"}`))
+	req.Header.Set("X-Api-Key", "abc")
+	router.ServeHTTP(w, req)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/missing", nil)
+	router.ServeHTTP(w, req)
+
+	recorded := router.Recorded()
+	assert.Len(t, recorded, 2)
+
+	assert.Equal(t, "POST", recorded[0].Method)
+	assert.Equal(t, "/foo", recorded[0].Path)
+	assert.Equal(t, "abc", recorded[0].Header.Get("X-Api-Key"))
+	assert.Equal(t, `{"name":"sprocket"}`, string(recorded[0].Body))
+	assert.Equal(t, 0, recorded[0].RouteIndex)
+	assert.True(t, recorded[0].Ordered)
+
+	assert.Equal(t, -1, recorded[1].RouteIndex)
+	assert.False(t, recorded[1].Ordered)
+}
+
+func TestServeHTTP_AssertRequestJSON(t *testing.T) {
+	router := Router{}
+	router.RegisterResp("POST", "/foo", 202, "")
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/foo", strings.NewReader(`{"name":"sprocket"}`))
+	router.ServeHTTP(w, req)
+
+	assert.True(t, router.AssertRequestJSON(t, 0, map[string]string{"name": "sprocket"}))
+
+	tt := &testing.T{}
+	router.AssertRequestJSON(tt, 0, map[string]string{"name": "widget"})
+	assert.True(t, tt.Failed())
+}
+
+func TestServeHTTP_AssertRequestHeader(t *testing.T) {
+	router := Router{}
+	router.RegisterResp("GET", "/foo", 200, "")
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/foo", nil)
+	req.Header.Set("X-Api-Key", "abc")
+	router.ServeHTTP(w, req)
+
+	assert.True(t, router.AssertRequestHeader(t, 0, "X-Api-Key", "abc"))
+
+	tt := &testing.T{}
+	router.AssertRequestHeader(tt, 0, "X-Api-Key", "def")
+	assert.True(t, tt.Failed())
+}
+
 func TestAssertVisited_UnvisitedRoute(t *testing.T) {
 	router := Router{}
 	router.RegisterResp("GET", "/foo", 200, "")